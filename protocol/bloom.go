@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// UpdOperationCacheDigestRequest carries a Bloom filter digest in place of
+// an enumerated UpdPayloadCacheRequest. A responder returns any message
+// whose key isn't in the filter as a normal UpdPayloadCacheResponse; see
+// EncodeCacheDigestRequest for the version-gated fallback.
+const UpdOperationCacheDigestRequest = 5
+
+// CacheBloom is a Bloom filter over hash(Source.Bytes() || SeqCounter)
+// keys, used to advertise a cache's contents in bounded space instead of
+// enumerating every (SeqCounter, Contact) pair.
+type CacheBloom struct {
+	M    uint32
+	K    uint8
+	Bits []byte
+}
+
+// NewCacheBloom returns an empty Bloom filter sized for n expected
+// elements at the given false-positive rate, computing m and k from the
+// standard m = -n*ln(p)/(ln2)^2, k = (m/n)*ln2 formulas.
+func NewCacheBloom(n uint32, fpRate float64) *CacheBloom {
+	if n == 0 {
+		n = 1
+	}
+
+	m := uint32(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m == 0 {
+		m = 1
+	}
+
+	k := uint8(math.Round((float64(m) / float64(n)) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &CacheBloom{
+		M:    m,
+		K:    k,
+		Bits: make([]byte, (m+7)/8),
+	}
+}
+
+// cacheBloomKey builds the key hashed into the filter for a cached
+// message: hash(Source.Bytes() || SeqCounter).
+func cacheBloomKey(source Contact, seq uint64) []byte {
+	sb := source.Bytes()
+
+	buf := make([]byte, len(sb)+8)
+	copy(buf, sb)
+	binary.LittleEndian.PutUint64(buf[len(sb):], seq)
+
+	return buf
+}
+
+// hashes returns the k bit indices for key, synthesizing k hash functions
+// by double-hashing two fnv64 seeds as h1 + i*h2, per Kirsch-Mitzenmacher.
+func (b *CacheBloom) hashes(key []byte) []uint32 {
+	h1 := fnv.New64()
+	h1.Write(key)
+	s1 := h1.Sum64()
+
+	h2 := fnv.New64a()
+	h2.Write(key)
+	s2 := h2.Sum64()
+
+	idx := make([]uint32, b.K)
+	for i := uint8(0); i < b.K; i++ {
+		idx[i] = uint32((s1 + uint64(i)*s2) % uint64(b.M))
+	}
+
+	return idx
+}
+
+// Add sets the bits for source/seq's key in the filter.
+func (b *CacheBloom) Add(source Contact, seq uint64) {
+	for _, i := range b.hashes(cacheBloomKey(source, seq)) {
+		b.Bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Contains reports whether source/seq's key may already be in the filter.
+// False positives are possible; false negatives are not.
+func (b *CacheBloom) Contains(source Contact, seq uint64) bool {
+	for _, i := range b.hashes(cacheBloomKey(source, seq)) {
+		if b.Bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Bytes encodes the filter as [m uint32][k uint8][bits...].
+func (b *CacheBloom) Bytes() []byte {
+	buf := make([]byte, 5+len(b.Bits))
+
+	binary.LittleEndian.PutUint32(buf[0:4], b.M)
+	buf[4] = b.K
+	copy(buf[5:], b.Bits)
+
+	return buf
+}
+
+// EncodeCacheDigestRequest returns digest's bytes under
+// UpdOperationCacheDigestRequest when peerVersion is at least ProtoVersion2,
+// falling back to fallback's existing enumeration under
+// UpdOperationCacheRequest for peers that haven't negotiated that far.
+func EncodeCacheDigestRequest(peerVersion uint8, digest *CacheBloom, fallback *UpdPayloadCacheRequest) (op uint8, data []byte) {
+	if peerVersion < ProtoVersion2 {
+		return UpdOperationCacheRequest, fallback.Bytes()
+	}
+
+	return UpdOperationCacheDigestRequest, digest.Bytes()
+}
+
+// MaxCacheBloomBits bounds the m ParseCacheBloom will accept, mirroring
+// MaxUpdPayloadBytes.
+var MaxCacheBloomBits uint32 = 1 << 24
+
+// ParseCacheBloom parses a Bloom filter encoded by Bytes.
+func ParseCacheBloom(buf []byte) *CacheBloom {
+	if len(buf) < 5 {
+		logrus.Warn("Upd: failed to parse cache bloom digest")
+		return nil
+	}
+
+	m := binary.LittleEndian.Uint32(buf[0:4])
+	k := buf[4]
+
+	if m == 0 || k == 0 {
+		logrus.Warn("Upd: failed to parse cache bloom digest, m or k is zero")
+		return nil
+	}
+
+	if m > MaxCacheBloomBits {
+		logrus.Warn("Upd: failed to parse cache bloom digest, m exceeds MaxCacheBloomBits")
+		return nil
+	}
+
+	// nbytes is computed in uint64 so a large m can't wrap around to a
+	// small byte count and slip past the length check below.
+	nbytes := (uint64(m) + 7) / 8
+	if uint64(len(buf)-5) < nbytes {
+		logrus.Warn("Upd: failed to parse cache bloom digest, bits truncated")
+		return nil
+	}
+
+	bits := make([]byte, nbytes)
+	copy(bits, buf[5:5+nbytes])
+
+	return &CacheBloom{M: m, K: k, Bits: bits}
+}
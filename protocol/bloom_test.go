@@ -0,0 +1,54 @@
+package protocol
+
+import "testing"
+
+func TestParseCacheBloomRejectsZeroMOrK(t *testing.T) {
+	cases := []struct {
+		name string
+		buf  []byte
+	}{
+		{"zero m", []byte{0, 0, 0, 0, 1}},
+		{"zero k", []byte{8, 0, 0, 0, 0, 0xff}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if b := ParseCacheBloom(c.buf); b != nil {
+				t.Fatalf("ParseCacheBloom(%v) = %+v, want nil", c.buf, b)
+			}
+		})
+	}
+}
+
+func TestParseCacheBloomRejectsOversizedM(t *testing.T) {
+	buf := make([]byte, 5)
+	buf[0] = 0xff
+	buf[1] = 0xff
+	buf[2] = 0xff
+	buf[3] = 0xff
+	buf[4] = 1
+
+	if b := ParseCacheBloom(buf); b != nil {
+		t.Fatalf("ParseCacheBloom accepted m above MaxCacheBloomBits: %+v", b)
+	}
+}
+
+func TestNewCacheBloomAddContainsRoundTrip(t *testing.T) {
+	b := NewCacheBloom(100, 0.01)
+
+	source := Contact{}
+	b.Add(source, 42)
+
+	if !b.Contains(source, 42) {
+		t.Fatal("Contains returned false for a key that was Added")
+	}
+
+	parsed := ParseCacheBloom(b.Bytes())
+	if parsed == nil {
+		t.Fatal("ParseCacheBloom(b.Bytes()) = nil")
+	}
+
+	if !parsed.Contains(source, 42) {
+		t.Fatal("round-tripped filter lost the Added key")
+	}
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+
+	// This pins the pre-modules (v1) github.com/pierrec/lz4 API, to
+	// match the GOPATH-era github.com/Sirupsen/logrus dependency this
+	// package already uses. In that API CompressBlock's third argument is
+	// a []int hash-table scratch slice, not an offset; nil is valid and
+	// means "let it allocate one internally". UncompressBlock takes no
+	// such argument.
+	"github.com/pierrec/lz4"
+)
+
+// UpdOperationCacheResponseCompressed carries an LZ4-compressed
+// UpdPayloadCacheResponse, selected by EncodeCacheResponse when doing so
+// actually shrinks the payload.
+const UpdOperationCacheResponseCompressed = 4
+
+// compressionThreshold is the uncompressed size below which
+// EncodeCacheResponse doesn't bother compressing, since LZ4's framing
+// overhead outweighs the savings on small responses.
+const compressionThreshold = 256
+
+// MaxDecompressedCacheResponseBytes bounds the uncompressed size
+// DecodeCompressedCacheResponse will allocate for.
+var MaxDecompressedCacheResponseBytes uint32 = 1024 * 1024
+
+// EncodeCacheResponse serializes r and, when it's worth it, compresses
+// the result with LZ4, returning the operation it should be sent under.
+// Responses under compressionThreshold or that fail to shrink under
+// compression are returned uncompressed under UpdOperationCacheResponse,
+// so the heuristic never costs more than it saves.
+func EncodeCacheResponse(r *UpdPayloadCacheResponse) (op uint8, data []byte, err error) {
+	raw := r.Bytes()
+
+	if len(raw) < compressionThreshold {
+		return UpdOperationCacheResponse, raw, nil
+	}
+
+	compressed := make([]byte, lz4.CompressBlockBound(len(raw)))
+
+	n, err := lz4.CompressBlock(raw, compressed, nil)
+	if err != nil || n == 0 || n+4 >= len(raw) {
+		return UpdOperationCacheResponse, raw, nil
+	}
+
+	out := make([]byte, 4+n)
+	binary.LittleEndian.PutUint32(out, uint32(len(raw)))
+	copy(out[4:], compressed[:n])
+
+	return UpdOperationCacheResponseCompressed, out, nil
+}
+
+// DecodeCompressedCacheResponse decompresses a buffer produced by
+// EncodeCacheResponse under UpdOperationCacheResponseCompressed, rejecting
+// declared uncompressed sizes above MaxDecompressedCacheResponseBytes, and
+// parses the result as a cache response.
+func DecodeCompressedCacheResponse(buf []byte) (*UpdPayloadCacheResponse, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("compressed cache response too short")
+	}
+
+	rawLen := binary.LittleEndian.Uint32(buf[0:4])
+	if rawLen > MaxDecompressedCacheResponseBytes {
+		return nil, errors.New("compressed cache response exceeds MaxDecompressedCacheResponseBytes")
+	}
+
+	raw := make([]byte, rawLen)
+
+	n, err := lz4.UncompressBlock(buf[4:], raw)
+	if err != nil {
+		return nil, err
+	}
+
+	pcr := ParsePayloadCacheResponse(raw[:n])
+	if pcr == nil {
+		return nil, errors.New("failed to parse decompressed cache response")
+	}
+
+	return pcr, nil
+}
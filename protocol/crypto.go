@@ -0,0 +1,272 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Operations for the encrypted Upd transport, used in place of the
+// plaintext cache request/response operations once peers share a
+// SessionKeys.
+const (
+	UpdOperationEncryptedRequest  = 2
+	UpdOperationEncryptedResponse = 3
+)
+
+const (
+	// hkdfInfo is the HKDF context string mixed into key derivation so
+	// Upd session keys can't be confused with keys derived from the same
+	// shared secret for other purposes.
+	hkdfInfo = "hamgo-upd-v1"
+
+	// sessionKeyBits is the size of the AES key derived from the HKDF
+	// stream.
+	sessionKeyBits = 256
+
+	// keyRotationThreshold is the number of messages a session key may
+	// encrypt before the next EncryptPayload call rotates to a fresh
+	// salt and re-derives keys.
+	keyRotationThreshold = 1000
+
+	// saltSize is the size of the per-session HKDF salt, also the size
+	// of the salt prefix EncryptPayload/DecryptPayload exchange inline
+	// so both sides always derive the same keys, even across rotation.
+	saltSize = sha256.Size
+)
+
+// SessionKeys holds the symmetric key material for one encrypted Upd
+// session. seq counts messages encrypted or decrypted under the current
+// salt, and drives the rotation in EncryptPayload; DecryptPayload instead
+// re-derives keys whenever a frame carries a different salt.
+type SessionKeys struct {
+	secret  []byte
+	salt    []byte
+	seq     uint64
+	aesKey  []byte
+	hmacKey []byte
+}
+
+// NewSessionKeys derives session keys for the initiating side of a
+// session from secret, using a random per-session salt that's prepended
+// to every EncryptPayload frame.
+func NewSessionKeys(secret []byte) (*SessionKeys, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return newSessionKeys(secret, salt)
+}
+
+// NewPeerSessionKeys returns session keys for the receiving side, keyed
+// only by secret; aesKey/hmacKey are derived lazily by the first
+// DecryptPayload call and re-derived whenever the salt changes.
+func NewPeerSessionKeys(secret []byte) *SessionKeys {
+	return &SessionKeys{secret: secret}
+}
+
+// newSessionKeys derives an AES key and an HMAC key from secret and salt
+// via HKDF-SHA256. The CTR nonce isn't derived here: it's generated
+// fresh per message in EncryptPayload, since reusing a static IV across
+// CTR-mode messages would break confidentiality.
+func newSessionKeys(secret, salt []byte) (*SessionKeys, error) {
+	h := hkdf.New(sha256.New, secret, salt, []byte(hkdfInfo))
+
+	aesKey := make([]byte, sessionKeyBits/8)
+	if _, err := io.ReadFull(h, aesKey); err != nil {
+		return nil, err
+	}
+
+	hmacKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(h, hmacKey); err != nil {
+		return nil, err
+	}
+
+	return &SessionKeys{
+		secret:  secret,
+		salt:    salt,
+		aesKey:  aesKey,
+		hmacKey: hmacKey,
+	}, nil
+}
+
+// rotateIfNeeded re-derives k's keys from a fresh random salt once seq
+// reaches keyRotationThreshold, then resets the counter. The new salt
+// rides along on the next EncryptPayload frame, so the peer rotates in
+// step.
+func (k *SessionKeys) rotateIfNeeded() error {
+	if k.seq < keyRotationThreshold {
+		return nil
+	}
+
+	rotated, err := NewSessionKeys(k.secret)
+	if err != nil {
+		return err
+	}
+
+	k.salt = rotated.salt
+	k.aesKey = rotated.aesKey
+	k.hmacKey = rotated.hmacKey
+	k.seq = 0
+
+	return nil
+}
+
+// EncryptPayload encrypts data with AES-CTR keyed from k and authenticates
+// the result with HMAC-SHA256, returning salt||nonce||ciphertext||tag. It
+// advances k's sequence counter and rotates the session keys once
+// keyRotationThreshold is crossed.
+func EncryptPayload(k *SessionKeys, data []byte) ([]byte, error) {
+	if err := k.rotateIfNeeded(); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(k.aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, nonce).XORKeyStream(ciphertext, data)
+
+	mac := hmac.New(sha256.New, k.hmacKey)
+	mac.Write(k.salt)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	tag := mac.Sum(nil)
+
+	out := make([]byte, 0, len(k.salt)+len(nonce)+len(ciphertext)+len(tag))
+	out = append(out, k.salt...)
+	out = append(out, nonce...)
+	out = append(out, ciphertext...)
+	out = append(out, tag...)
+
+	k.seq++
+
+	return out, nil
+}
+
+// EncryptCacheRequest serializes r and encrypts it with EncryptPayload under
+// k, returning the operation it should be sent under. Mirrors
+// EncodeCacheResponse's serialize-then-wrap pattern for the cache response
+// side.
+func EncryptCacheRequest(k *SessionKeys, r *UpdPayloadCacheRequest) (op uint8, data []byte, err error) {
+	enc, err := EncryptPayload(k, r.Bytes())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return UpdOperationEncryptedRequest, enc, nil
+}
+
+// DecryptCacheRequest decrypts buf with DecryptPayload under k and parses
+// the result as a cache request.
+func DecryptCacheRequest(k *SessionKeys, buf []byte) (*UpdPayloadCacheRequest, error) {
+	raw, err := DecryptPayload(k, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := ParsePayloadCacheRequest(raw)
+	if cr == nil {
+		return nil, errors.New("failed to parse decrypted cache request")
+	}
+
+	return cr, nil
+}
+
+// EncryptCacheResponse serializes r and encrypts it with EncryptPayload
+// under k, returning the operation it should be sent under.
+func EncryptCacheResponse(k *SessionKeys, r *UpdPayloadCacheResponse) (op uint8, data []byte, err error) {
+	enc, err := EncryptPayload(k, r.Bytes())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return UpdOperationEncryptedResponse, enc, nil
+}
+
+// DecryptCacheResponse decrypts buf with DecryptPayload under k and parses
+// the result as a cache response.
+func DecryptCacheResponse(k *SessionKeys, buf []byte) (*UpdPayloadCacheResponse, error) {
+	raw, err := DecryptPayload(k, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	pcr := ParsePayloadCacheResponse(raw)
+	if pcr == nil {
+		return nil, errors.New("failed to parse decrypted cache response")
+	}
+
+	return pcr, nil
+}
+
+// DecryptPayload verifies and decrypts a buffer produced by EncryptPayload
+// for the secret k was built from, re-deriving k's keys from the frame's
+// salt first if it doesn't match k's current salt.
+func DecryptPayload(k *SessionKeys, buf []byte) ([]byte, error) {
+	if len(buf) < saltSize {
+		return nil, errors.New("encrypted payload too short")
+	}
+
+	salt := buf[:saltSize]
+	buf = buf[saltSize:]
+
+	if !bytes.Equal(salt, k.salt) {
+		rotated, err := newSessionKeys(k.secret, append([]byte(nil), salt...))
+		if err != nil {
+			return nil, err
+		}
+
+		k.salt = rotated.salt
+		k.aesKey = rotated.aesKey
+		k.hmacKey = rotated.hmacKey
+		k.seq = 0
+	}
+
+	block, err := aes.NewCipher(k.aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceLen := block.BlockSize()
+	tagLen := sha256.Size
+
+	if len(buf) < nonceLen+tagLen {
+		return nil, errors.New("encrypted payload too short")
+	}
+
+	nonce := buf[:nonceLen]
+	ciphertext := buf[nonceLen : len(buf)-tagLen]
+	tag := buf[len(buf)-tagLen:]
+
+	mac := hmac.New(sha256.New, k.hmacKey)
+	mac.Write(salt)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, errors.New("encrypted payload failed authentication")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, nonce).XORKeyStream(plaintext, ciphertext)
+
+	k.seq++
+
+	return plaintext, nil
+}
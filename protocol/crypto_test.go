@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecryptPayloadRoundTrip(t *testing.T) {
+	secret := []byte("shared secret passphrase")
+
+	sender, err := NewSessionKeys(secret)
+	if err != nil {
+		t.Fatalf("NewSessionKeys: %v", err)
+	}
+
+	receiver := NewPeerSessionKeys(secret)
+
+	want := []byte("hamgo cache traffic")
+
+	enc, err := EncryptPayload(sender, want)
+	if err != nil {
+		t.Fatalf("EncryptPayload: %v", err)
+	}
+
+	got, err := DecryptPayload(receiver, enc)
+	if err != nil {
+		t.Fatalf("DecryptPayload: %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("DecryptPayload = %q, want %q", got, want)
+	}
+}
+
+func TestDecryptPayloadRejectsTamperedCiphertext(t *testing.T) {
+	secret := []byte("shared secret passphrase")
+
+	sender, err := NewSessionKeys(secret)
+	if err != nil {
+		t.Fatalf("NewSessionKeys: %v", err)
+	}
+
+	receiver := NewPeerSessionKeys(secret)
+
+	enc, err := EncryptPayload(sender, []byte("hamgo cache traffic"))
+	if err != nil {
+		t.Fatalf("EncryptPayload: %v", err)
+	}
+
+	enc[len(enc)-1] ^= 0xff
+
+	if _, err := DecryptPayload(receiver, enc); err == nil {
+		t.Fatal("DecryptPayload accepted a tampered frame")
+	}
+}
+
+func TestEncryptDecryptPayloadRotatesKeys(t *testing.T) {
+	secret := []byte("shared secret passphrase")
+
+	sender, err := NewSessionKeys(secret)
+	if err != nil {
+		t.Fatalf("NewSessionKeys: %v", err)
+	}
+
+	receiver := NewPeerSessionKeys(secret)
+	initialSalt := append([]byte(nil), sender.salt...)
+
+	for i := 0; i < keyRotationThreshold+1; i++ {
+		want := []byte("message")
+
+		enc, err := EncryptPayload(sender, want)
+		if err != nil {
+			t.Fatalf("EncryptPayload at %d: %v", i, err)
+		}
+
+		got, err := DecryptPayload(receiver, enc)
+		if err != nil {
+			t.Fatalf("DecryptPayload at %d: %v", i, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("DecryptPayload at %d = %q, want %q", i, got, want)
+		}
+	}
+
+	if bytes.Equal(sender.salt, initialSalt) {
+		t.Fatal("expected session keys to rotate to a new salt after keyRotationThreshold messages")
+	}
+
+	if !bytes.Equal(receiver.salt, sender.salt) {
+		t.Fatal("expected receiver to mirror the sender's rotated salt")
+	}
+}
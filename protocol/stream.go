@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// MaxUpdPayloadBytes bounds the declared body size ReadUpdPayload and
+// ReadPayloadEntry will allocate for, mirroring the length-cap pattern
+// ssh-agent's ServeAgent uses for its own message framing.
+var MaxUpdPayloadBytes uint32 = 64 * 1024
+
+// ReadUpdPayload reads a single UpdPayload from r. It reads the fixed
+// 3-byte header with io.ReadFull before allocating and reading the
+// declared body, rejecting bodies larger than MaxUpdPayloadBytes.
+func ReadUpdPayload(r io.Reader) (*UpdPayload, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	upd := UpdPayload{
+		Operation:  hdr[0],
+		DataLength: binary.LittleEndian.Uint16(hdr[1:3]),
+	}
+
+	if uint32(upd.DataLength) > MaxUpdPayloadBytes {
+		return nil, errors.New("upd payload exceeds MaxUpdPayloadBytes")
+	}
+
+	upd.Data = make([]byte, upd.DataLength)
+	if _, err := io.ReadFull(r, upd.Data); err != nil {
+		return nil, err
+	}
+
+	return &upd, nil
+}
+
+// WriteUpdPayload writes u to w using the existing wire framing. Unlike
+// Bytes(), it writes the header and body directly to w so callers can
+// pipe payloads to a net.Conn without staging the full frame in memory.
+func WriteUpdPayload(w io.Writer, u *UpdPayload) error {
+	hdr := make([]byte, 3)
+	hdr[0] = u.Operation
+	binary.LittleEndian.PutUint16(hdr[1:3], u.DataLength)
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(u.Data[:u.DataLength]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadPayloadEntry reads a single UpdPayloadEntry from r, framed under
+// CurrentProtoVersion. It reads the fixed header with io.ReadFull before
+// allocating and reading the declared message body, rejecting messages
+// larger than MaxUpdPayloadBytes.
+func ReadPayloadEntry(r io.Reader) (*UpdPayloadEntry, error) {
+	hdrLen := 4
+	if CurrentProtoVersion >= ProtoVersion2 {
+		hdrLen = 8
+	}
+
+	hdr := make([]byte, hdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(hdr[0:4])
+	if length > MaxUpdPayloadBytes {
+		return nil, errors.New("upd payload entry exceeds MaxUpdPayloadBytes")
+	}
+
+	var crc uint32
+	if CurrentProtoVersion >= ProtoVersion2 {
+		crc = binary.LittleEndian.Uint32(hdr[4:8])
+	}
+
+	msgBuf := make([]byte, length)
+	if _, err := io.ReadFull(r, msgBuf); err != nil {
+		return nil, err
+	}
+
+	if CurrentProtoVersion >= ProtoVersion2 && crc32.Checksum(msgBuf, crc32cTable) != crc {
+		return nil, errors.New("upd payload entry failed CRC check")
+	}
+
+	msg, _ := ParseMessage(msgBuf)
+	if msg == nil {
+		return nil, errors.New("upd payload entry: failed to parse message")
+	}
+
+	return &UpdPayloadEntry{Length: length, Message: *msg}, nil
+}
@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -13,6 +14,22 @@ const (
 	UpdOperationCacheResponse = 1
 )
 
+// Protocol versions gate the on-wire framing used for UpdPayloadEntry.
+// ProtoVersion1 is the original length-prefixed framing with no
+// integrity check; ProtoVersion2 adds a CRC32C checksum of the message
+// bytes immediately after the length field.
+const (
+	ProtoVersion1 = 1
+	ProtoVersion2 = 2
+
+	// CurrentProtoVersion is the framing version spoken by this node.
+	CurrentProtoVersion = ProtoVersion2
+)
+
+// crc32cTable is the Castagnoli CRC32 table used to checksum entry
+// frames, computed once at package init.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 // UpdPayload defines the payload for hamgo signaling.
 type UpdPayload struct {
 	Operation  uint8
@@ -50,28 +67,63 @@ type UpdPayloadCacheResponse struct {
 	Entries    []UpdPayloadEntry
 }
 
-// Bytes converts an entry to bytes.
+// Bytes converts an entry to bytes using the framing of CurrentProtoVersion.
 func (e *UpdPayloadEntry) Bytes() []byte {
+	return e.BytesVersion(CurrentProtoVersion)
+}
+
+// BytesVersion converts an entry to bytes using the framing of the given
+// protocol version, so callers can downgrade to ProtoVersion1 framing for
+// peers that haven't negotiated the CRC32C checksum.
+func (e *UpdPayloadEntry) BytesVersion(version uint8) []byte {
 	msb := e.Message.Bytes()
 	lm := len(msb)
 
-	buf := make([]byte, 4+lm)
+	if version < ProtoVersion2 {
+		buf := make([]byte, 4+lm)
+		idx := 0
+
+		binary.LittleEndian.PutUint32(buf[idx:], uint32(lm))
+		idx += 4
+
+		copy(buf[idx:], msb)
+		return buf
+	}
+
+	buf := make([]byte, 8+lm)
 	idx := 0
 
 	binary.LittleEndian.PutUint32(buf[idx:], uint32(lm))
 	idx += 4
 
+	binary.LittleEndian.PutUint32(buf[idx:], crc32.Checksum(msb, crc32cTable))
+	idx += 4
+
 	copy(buf[idx:], msb)
 	return buf
 }
 
-// ParsePayloadEntry parses an entry and tries to fail gracefully if the
-// message is corrupted.
+// ParsePayloadEntry parses an entry framed under CurrentProtoVersion and
+// tries to fail gracefully if the message is corrupted.
 func ParsePayloadEntry(buf []byte) (*UpdPayloadEntry, []byte) {
+	return ParsePayloadEntryVersion(buf, CurrentProtoVersion)
+}
+
+// ParsePayloadEntryVersion parses an entry framed under the given protocol
+// version. Under ProtoVersion2 it verifies the CRC32C checksum before
+// handing the message to ParseMessage, and skips the entry using the
+// length prefix rather than failing the whole stream when the checksum
+// doesn't match.
+func ParsePayloadEntryVersion(buf []byte, version uint8) (*UpdPayloadEntry, []byte) {
 	re := UpdPayloadEntry{}
 	idx := 0
 
-	if len(buf) < 4 {
+	hdrLen := 4
+	if version >= ProtoVersion2 {
+		hdrLen = 8
+	}
+
+	if len(buf) < hdrLen {
 		logrus.Warn("Upd: Failed to parse payload entry")
 		return nil, nil
 	}
@@ -79,19 +131,33 @@ func ParsePayloadEntry(buf []byte) (*UpdPayloadEntry, []byte) {
 	re.Length = binary.LittleEndian.Uint32(buf[idx : idx+4])
 	idx += 4
 
+	var crc uint32
+	if version >= ProtoVersion2 {
+		crc = binary.LittleEndian.Uint32(buf[idx : idx+4])
+		idx += 4
+	}
+
 	if len(buf) < idx+int(re.Length) {
 		logrus.Warn("Upd: Failed to parse payload entry, msg length > buf len")
 		return nil, nil
 	}
 
-	msg, _ := ParseMessage(buf[idx:])
+	msgBuf := buf[idx : idx+int(re.Length)]
+	rbuf := buf[idx+int(re.Length):]
+
+	if version >= ProtoVersion2 && crc32.Checksum(msgBuf, crc32cTable) != crc {
+		logrus.Warn("Upd: payload entry failed CRC check, skipping entry")
+		return nil, rbuf
+	}
+
+	msg, _ := ParseMessage(msgBuf)
 	if msg == nil {
 		logrus.Warn("Upd: failed to parse message, ignoring and continuing")
-		return nil, buf[idx+int(re.Length):]
+		return nil, rbuf
 	}
 
 	re.Message = *msg
-	return &re, buf[idx+int(re.Length):]
+	return &re, rbuf
 }
 
 // Bytes converts a cache entry to bytes.
@@ -195,15 +261,21 @@ func ParsePayloadCacheResponse(buf []byte) *UpdPayloadCacheResponse {
 	pcr.NumEntries = binary.LittleEndian.Uint32(buf[idx : idx+4])
 	idx += 4
 
+	buf = buf[idx:]
 	for i := 0; i < int(pcr.NumEntries); i++ {
-		m, rbuf := ParsePayloadEntry(buf[idx:])
+		m, rbuf := ParsePayloadEntry(buf)
 		if m == nil {
-			logrus.Warn("Upd: failed to parse cache response, skipping message")
+			if rbuf == nil {
+				logrus.Warn("Upd: failed to parse cache response, stream desynced, aborting")
+				break
+			}
+
+			logrus.Warn("Upd: failed to parse cache response, skipping corrupted entry")
+			buf = rbuf
 			continue
 		}
 
 		pcr.Entries = append(pcr.Entries, *m)
-		idx = 0
 		buf = rbuf
 	}
 
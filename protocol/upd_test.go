@@ -0,0 +1,37 @@
+package protocol
+
+import "testing"
+
+// TestParsePayloadCacheResponseSkipsCorruptedEntry exercises the fix to
+// ParsePayloadCacheResponse's skip path: a CRC mismatch on one entry must
+// not desync the stream and lose the entries that follow it.
+func TestParsePayloadCacheResponseSkipsCorruptedEntry(t *testing.T) {
+	entries := []UpdPayloadEntry{
+		{Message: Message{}},
+		{Message: Message{}},
+		{Message: Message{}},
+	}
+
+	var buf []byte
+	for i, e := range entries {
+		b := e.Bytes()
+		if i == 1 {
+			// Invert the first byte of the CRC field (bytes 4-7) so the middle
+			// entry fails its checksum without touching its length.
+			b[4] ^= 0xff
+		}
+		buf = append(buf, b...)
+	}
+
+	resp := UpdPayloadCacheResponse{NumEntries: uint32(len(entries))}
+	full := append(resp.Bytes(), buf...)
+
+	pcr := ParsePayloadCacheResponse(full)
+	if pcr == nil {
+		t.Fatal("ParsePayloadCacheResponse returned nil")
+	}
+
+	if len(pcr.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2 (corrupted middle entry skipped, not desynced)", len(pcr.Entries))
+	}
+}